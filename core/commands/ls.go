@@ -1,19 +1,38 @@
 package commands
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"os"
+	gopath "path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
 	"text/tabwriter"
+	"time"
 
 	cmdenv "github.com/ipfs/go-ipfs/core/commands/cmdenv"
 	e "github.com/ipfs/go-ipfs/core/commands/e"
 	iface "github.com/ipfs/go-ipfs/core/coreapi/interface"
 
+	bstore "gx/ipfs/QmTVDM4LCSUMFNQzbDLodXMVujmSpC2ruaTTuibBd1ZoiK/go-ipfs-blockstore"
+	car "gx/ipfs/QmRpt9RXLyAipgAJc6rFNbgBzLzVZcBt3uriRBsfFbS45S/go-car"
+	carutil "gx/ipfs/QmRpt9RXLyAipgAJc6rFNbgBzLzVZcBt3uriRBsfFbS45S/go-car/util"
 	cid "gx/ipfs/QmPSQnBKM9g7BaUcZCvswUJVscQ1ipjmwxN5PXCjkp9EQ7/go-cid"
+	ds "gx/ipfs/QmUadX5EcvrBmxAv9sqAodBmekVzgkAxj7DD45YnAtUBNh/go-datastore"
+	dssync "gx/ipfs/QmUadX5EcvrBmxAv9sqAodBmekVzgkAxj7DD45YnAtUBNh/go-datastore/sync"
+	ipldcbor "gx/ipfs/QmSywXwbx5aNxMsS2DjvRM1PgGnspxxNnWYgVQEPVpdYRk/go-ipld-cbor"
 	ipld "gx/ipfs/QmR7TcHkR9nxkUorfi8XMTAMLUK7GiP64TWWBzY3aacc1o/go-ipld-format"
 	cmds "gx/ipfs/QmSXUokcP4TJpFfqozT69AVAYRtzXVMUjzQVkYX41R9Svs/go-ipfs-cmds"
 	merkledag "gx/ipfs/QmSei8kFMfqdJq7Q68d2LMnHbTWKKg2daA29ezUYFAUNgc/go-merkledag"
 	offline "gx/ipfs/QmT6dHGp3UYd3vUMpy7rzX2CXQv7HLcj42Vtq8qwwjgASb/go-ipfs-exchange-offline"
+	// --long (below) calls FSNode.Mode()/FSNode.ModTime(), which only exist
+	// on a go-unixfs revision that carries UnixFS v1.5 metadata support; the
+	// pin below must not be rolled back past that without also reverting
+	// --long, or the package fails to compile.
 	unixfs "gx/ipfs/QmUaZkqxmKvUX16F8XeAAk9LVvmNMktvbhcx4PG4s8SqDG/go-unixfs"
 	uio "gx/ipfs/QmUaZkqxmKvUX16F8XeAAk9LVvmNMktvbhcx4PG4s8SqDG/go-unixfs/io"
 	unixfspb "gx/ipfs/QmUaZkqxmKvUX16F8XeAAk9LVvmNMktvbhcx4PG4s8SqDG/go-unixfs/pb"
@@ -25,7 +44,17 @@ import (
 type LsLink struct {
 	Name, Hash string
 	Size       uint64
-	Type       unixfspb.Data_DataType
+	// ContentSize is the UnixFS content byte count (as opposed to Size,
+	// which is the merkledag descendant size and includes framing/typing
+	// overhead). Only populated when --size=content or --size=both.
+	ContentSize uint64 `json:",omitempty"`
+	Type        unixfspb.Data_DataType
+	// Mode, Mtime, MtimeNsecs, and Target are only populated with --long,
+	// and only for UnixFS v1.5+ nodes that carry this metadata.
+	Mode       uint32 `json:",omitempty"`
+	Mtime      int64  `json:",omitempty"`
+	MtimeNsecs int32  `json:",omitempty"`
+	Target     string `json:",omitempty"`
 }
 
 // LsObject is an element of LsOutput
@@ -37,6 +66,10 @@ type LsObject struct {
 	HasHeader bool
 	HasLinks  bool
 	HasFooter bool
+	// Path is the directory's path as reached by --recursive: the
+	// command-line argument it started from, followed by each subdirectory
+	// name, e.g. "<arg>/sub/dir". Empty outside --recursive.
+	Path string `json:",omitempty"`
 }
 
 // LsOutput is a set of printable data for directories
@@ -46,9 +79,32 @@ type LsOutput struct {
 }
 
 const (
-	lsHeadersOptionNameTime = "headers"
-	lsResolveTypeOptionName = "resolve-type"
-	lsStreamOptionName      = "stream"
+	lsHeadersOptionNameTime   = "headers"
+	lsResolveTypeOptionName   = "resolve-type"
+	lsStreamOptionName        = "stream"
+	lsFromCarOptionName       = "from-car"
+	lsToCarOptionName         = "to-car"
+	lsPathOptionName          = "path"
+	lsRecursiveOptionName     = "recursive"
+	lsMaxDepthOptionName      = "max-depth"
+	lsConcurrencyOptionName   = "concurrency"
+	lsSizeOptionName          = "size"
+	lsLongOptionName          = "long"
+	lsPatternOptionName       = "pattern"
+	lsPatternSyntaxOptionName = "pattern-syntax"
+	lsSortOptionName          = "sort"
+	lsReverseOptionName       = "reverse"
+
+	lsSizeDag     = "dag"
+	lsSizeContent = "content"
+	lsSizeBoth    = "both"
+
+	lsPatternSyntaxGlob  = "glob"
+	lsPatternSyntaxRegex = "regex"
+
+	lsSortName = "name"
+	lsSortSize = "size"
+	lsSortType = "type"
 )
 
 var LsCmd = &cmds.Command{
@@ -61,6 +117,32 @@ the following format:
   <link base58 hash> <link size in bytes> <link name>
 
 The JSON output contains type information.
+
+With --from-car, the listing is served out of a CAR file (or stdin, with
+"-") instead of the local blockstore, and --path descends into a UnixFS
+sub-path of the resolved object before listing it.
+
+With --recursive, subdirectories are listed transitively (optionally
+bounded by --max-depth), streaming a header/links/footer block per
+directory the same way --stream does for the top level.
+
+--size controls which size is reported: "dag" (default, the merkledag
+size including framing overhead, matching prior behaviour) or "content" (the UnixFS byte
+count that "ipfs cat" would produce); "both" prints both columns.
+
+--long/-l prints a "ls -l"-style line per entry (mode, size, mtime, and
+symlink target) for UnixFS v1.5+ nodes that carry this metadata.
+
+--pattern (glob by default, or regex with --pattern-syntax=regex) keeps
+only matching entries. --sort orders entries by "name", "size", or
+"type"; --reverse flips the order. With --stream, entries are still
+buffered per directory when --sort is given, but the header/footer
+streaming behaviour is otherwise unchanged.
+
+--enc=json turns --stream into newline-delimited JSON, one
+{"event":"header"|"link"|"footer",...} object per line, instead of
+whole listings glued together; --enc=application/cbor is the same
+event stream encoded as back-to-back CBOR items.
 `,
 	},
 
@@ -71,8 +153,20 @@ The JSON output contains type information.
 		cmdkit.BoolOption(lsHeadersOptionNameTime, "v", "Print table headers (Hash, Size, Name)."),
 		cmdkit.BoolOption(lsResolveTypeOptionName, "Resolve linked objects to find out their types.").WithDefault(true),
 		cmdkit.BoolOption(lsStreamOptionName, "s", "Stream directory entries as they are found."),
+		cmdkit.StringOption(lsFromCarOptionName, "Read blocks from a CAR file (or \"-\" for stdin) instead of the local blockstore."),
+		cmdkit.StringOption(lsToCarOptionName, "Write a CAR file containing the traversed blocks to the given path."),
+		cmdkit.StringOption(lsPathOptionName, "A UnixFS path, relative to the resolved object, to descend into before listing."),
+		cmdkit.BoolOption(lsRecursiveOptionName, "r", "List subdirectories recursively."),
+		cmdkit.IntOption(lsMaxDepthOptionName, "Limit the depth of recursion (-1 for unlimited).").WithDefault(-1),
+		cmdkit.IntOption(lsConcurrencyOptionName, "Number of directories to traverse concurrently with --recursive.").WithDefault(4),
+		cmdkit.StringOption(lsSizeOptionName, "Size to report: \"dag\" (merkledag size, default), \"content\" (UnixFS byte count), or \"both\".").WithDefault(lsSizeDag),
+		cmdkit.BoolOption(lsLongOptionName, "l", "Use a long listing format, showing mode, mtime, and symlink targets."),
+		cmdkit.StringOption(lsPatternOptionName, "Only list entries whose name matches this pattern."),
+		cmdkit.StringOption(lsPatternSyntaxOptionName, "Syntax for --pattern: \"glob\" (default) or \"regex\".").WithDefault(lsPatternSyntaxGlob),
+		cmdkit.StringOption(lsSortOptionName, "Sort entries by \"name\", \"size\", or \"type\"."),
+		cmdkit.BoolOption(lsReverseOptionName, "Reverse the sort order."),
 	},
-	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) (err error) {
 		nd, err := cmdenv.GetNode(env)
 		if err != nil {
 			return err
@@ -84,6 +178,16 @@ The JSON output contains type information.
 		}
 
 		resolve, _ := req.Options[lsResolveTypeOptionName].(bool)
+		sizeMode, _ := req.Options[lsSizeOptionName].(string)
+		long, _ := req.Options[lsLongOptionName].(bool)
+		pattern, _ := req.Options[lsPatternOptionName].(string)
+		patternSyntax, _ := req.Options[lsPatternSyntaxOptionName].(string)
+		filterFn, err := makeLsFilter(pattern, patternSyntax)
+		if err != nil {
+			return err
+		}
+		sortBy, _ := req.Options[lsSortOptionName].(string)
+		reverse, _ := req.Options[lsReverseOptionName].(bool)
 		dserv := nd.DAG
 		if !resolve {
 			offlineexch := offline.Exchange(nd.Blockstore)
@@ -97,25 +201,128 @@ The JSON output contains type information.
 		}
 
 		paths := req.Arguments
+		subPath, _ := req.Options[lsPathOptionName].(string)
 
 		var dagnodes []ipld.Node
-		for _, fpath := range paths {
-			p, err := iface.ParsePath(fpath)
+		fromCar, _ := req.Options[lsFromCarOptionName].(string)
+		if fromCar != "" {
+			carDserv, roots, err := dagServiceFromCar(fromCar)
 			if err != nil {
-				return err
+				return fmt.Errorf("failed to load car: %s", err)
 			}
+			dserv = carDserv
 
-			dagnode, err := api.ResolveNode(req.Context, p)
-			if err != nil {
-				return err
+			if len(paths) == 0 {
+				paths = []string{"."}
+			}
+			for _, fpath := range paths {
+				root, rest := splitCarPath(fpath)
+				var rootNd ipld.Node
+				if root != "" {
+					c, err := cid.Decode(root)
+					if err != nil {
+						return fmt.Errorf("invalid root %q: %s", root, err)
+					}
+					rootNd, err = dserv.Get(req.Context, c)
+					if err != nil {
+						return err
+					}
+				} else {
+					if len(roots) == 0 {
+						return fmt.Errorf("car file has no roots and no root was given in %q", fpath)
+					}
+					rootNd, err = dserv.Get(req.Context, roots[0])
+					if err != nil {
+						return err
+					}
+				}
+				dagnode, err := descendUnixfsPath(req.Context, dserv, rootNd, gopath.Join(rest, subPath))
+				if err != nil {
+					return err
+				}
+				dagnodes = append(dagnodes, dagnode)
+			}
+		} else {
+			for _, fpath := range paths {
+				p, err := iface.ParsePath(fpath)
+				if err != nil {
+					return err
+				}
+
+				dagnode, err := api.ResolveNode(req.Context, p)
+				if err != nil {
+					return err
+				}
+				if subPath != "" {
+					dagnode, err = descendUnixfsPath(req.Context, dserv, dagnode, subPath)
+					if err != nil {
+						return err
+					}
+				}
+				dagnodes = append(dagnodes, dagnode)
 			}
-			dagnodes = append(dagnodes, dagnode)
 		}
-		ng := merkledag.NewSession(req.Context, nd.DAG)
+		ng := merkledag.NewSession(req.Context, dserv)
 		ro := merkledag.NewReadOnlyDagService(ng)
 
+		var carOut *carCollector
+		toCar, _ := req.Options[lsToCarOptionName].(string)
+		if toCar != "" {
+			carOut = newCarCollector()
+			for _, dagnode := range dagnodes {
+				carOut.AddRoot(dagnode.Cid())
+				carOut.Add(dagnode)
+			}
+			defer func() {
+				if werr := carOut.WriteFile(toCar); werr != nil && err == nil {
+					err = fmt.Errorf("failed to write car: %s", werr)
+				}
+			}()
+		}
+
 		stream, _ := req.Options[lsStreamOptionName].(bool)
 		multipleFolders := len(req.Arguments) > 1
+
+		recursive, _ := req.Options[lsRecursiveOptionName].(bool)
+		if recursive {
+			maxDepth, _ := req.Options[lsMaxDepthOptionName].(int)
+			concurrency, _ := req.Options[lsConcurrencyOptionName].(int)
+			if concurrency < 1 {
+				concurrency = 1
+			}
+
+			w := &lsWalker{
+				req:      req,
+				res:      res,
+				dserv:    ro,
+				ro:       ro,
+				resolve:  resolve,
+				sizeMode: sizeMode,
+				long:     long,
+				filterFn: filterFn,
+				sortBy:   sortBy,
+				reverse:  reverse,
+				// Every emitted directory carries its own path prefix, so
+				// always render headers the way MultipleFolders does.
+				multipleFolders: true,
+				maxDepth:        maxDepth,
+				carOut:          carOut,
+				sem:             make(chan struct{}, concurrency),
+			}
+
+			var wg sync.WaitGroup
+			for i, dagnode := range dagnodes {
+				wg.Add(1)
+				w.sem <- struct{}{}
+				go func(prefix string, nd ipld.Node) {
+					defer func() { <-w.sem }()
+					w.walk(&wg, prefix, nd, 0)
+				}(paths[i], dagnode)
+			}
+			wg.Wait()
+			return w.err
+		}
+
 		if !stream {
 			output := make([]LsObject, len(req.Arguments))
 
@@ -134,14 +341,22 @@ The JSON output contains type information.
 						return err
 					}
 				}
+				if carOut != nil && dir != nil {
+					carOut.Add(dagnode)
+				}
 				outputLinks := make([]LsLink, len(links))
 				for j, link := range links {
-					lsLink, err := makeLsLink(req, dserv, resolve, link)
+					lsLink, linkNode, err := makeLsLink(req, dserv, resolve, sizeMode, recursive, long, link)
 					if err != nil {
 						return err
 					}
+					if err := carAddLink(req.Context, dserv, carOut, link, linkNode); err != nil {
+						return err
+					}
 					outputLinks[j] = *lsLink
 				}
+				outputLinks = filterLsLinks(outputLinks, filterFn)
+				sortLsLinks(outputLinks, sortBy, reverse)
 				output[i] = newFullDirectoryLsObject(paths[i], outputLinks)
 			}
 
@@ -154,6 +369,10 @@ The JSON output contains type information.
 				return fmt.Errorf("the data in %s (at %q) is not a UnixFS directory: %s", dagnode.Cid(), paths[i], err)
 			}
 
+			if carOut != nil && dir != nil {
+				carOut.Add(dagnode)
+			}
+
 			var linkResults <-chan unixfs.LinkResult
 			if dir == nil {
 				linkResults = makeDagNodeLinkResults(req, dagnode)
@@ -168,21 +387,42 @@ The JSON output contains type information.
 			if err = res.Emit(&LsOutput{multipleFolders, output}); err != nil {
 				return nil
 			}
+			var buffered []LsLink
 			for linkResult := range linkResults {
 				if linkResult.Err != nil {
 					return linkResult.Err
 				}
 				link := linkResult.Link
-				lsLink, err := makeLsLink(req, dserv, resolve, link)
+				if filterFn != nil && !filterFn(link.Name) {
+					continue
+				}
+				lsLink, linkNode, err := makeLsLink(req, dserv, resolve, sizeMode, recursive, long, link)
 				if err != nil {
 					return err
 				}
+				if err := carAddLink(req.Context, dserv, carOut, link, linkNode); err != nil {
+					return err
+				}
+				if sortBy != "" {
+					buffered = append(buffered, *lsLink)
+					continue
+				}
 				outputLinks[0] = *lsLink
 				output[0] = newDirectoryLinksLsObject(outputLinks)
 				if err = res.Emit(&LsOutput{multipleFolders, output}); err != nil {
 					return err
 				}
 			}
+			if sortBy != "" {
+				sortLsLinks(buffered, sortBy, reverse)
+				for _, lsLink := range buffered {
+					outputLinks[0] = lsLink
+					output[0] = newDirectoryLinksLsObject(outputLinks)
+					if err = res.Emit(&LsOutput{multipleFolders, output}); err != nil {
+						return err
+					}
+				}
+			}
 			output[0] = newDirectoryFooterLsObject()
 			if err = res.Emit(&LsOutput{multipleFolders, output}); err != nil {
 				return err
@@ -193,6 +433,8 @@ The JSON output contains type information.
 	Encoders: cmds.EncoderMap{
 		cmds.Text: cmds.MakeEncoder(func(req *cmds.Request, w io.Writer, v interface{}) error {
 			headers, _ := req.Options[lsHeadersOptionNameTime].(bool)
+			sizeMode, _ := req.Options[lsSizeOptionName].(string)
+			long, _ := req.Options[lsLongOptionName].(bool)
 			output, ok := v.(*LsOutput)
 			if !ok {
 				return e.TypeErr(output, v)
@@ -202,19 +444,41 @@ The JSON output contains type information.
 			for _, object := range output.Objects {
 				if object.HasHeader {
 					if output.MultipleFolders {
-						fmt.Fprintf(tw, "%s:\n", object.Hash)
+						label := object.Hash
+						if object.Path != "" {
+							label = object.Path
+						}
+						fmt.Fprintf(tw, "%s:\n", label)
 					}
 					if headers {
-						fmt.Fprintln(tw, "Hash\tSize\tName")
+						if sizeMode == lsSizeBoth {
+							fmt.Fprintln(tw, "Hash\tSize\tContentSize\tName")
+						} else {
+							fmt.Fprintln(tw, "Hash\tSize\tName")
+						}
 					}
 				}
 				if object.HasLinks {
 					for _, link := range object.Links {
+						name := link.Name
 						if link.Type == unixfs.TDirectory {
-							link.Name += "/"
+							name += "/"
 						}
 
-						fmt.Fprintf(tw, "%s\t%v\t%s\n", link.Hash, link.Size, link.Name)
+						if long {
+							fmt.Fprintln(tw, formatLsLinkLong(link, name))
+							continue
+						}
+
+						size := link.Size
+						if sizeMode == lsSizeContent {
+							size = link.ContentSize
+						}
+						if sizeMode == lsSizeBoth {
+							fmt.Fprintf(tw, "%s\t%v\t%v\t%s\n", link.Hash, link.Size, link.ContentSize, name)
+						} else {
+							fmt.Fprintf(tw, "%s\t%v\t%s\n", link.Hash, size, name)
+						}
 					}
 				}
 				if object.HasFooter {
@@ -226,10 +490,233 @@ The JSON output contains type information.
 			tw.Flush()
 			return nil
 		}),
+		cmds.JSON: cmds.MakeEncoder(encodeLsOutputNdjson),
+		lsCborEncodingType: cmds.MakeEncoder(encodeLsOutputCbor),
 	},
 	Type: LsOutput{},
 }
 
+// lsCborEncodingType registers the --enc=application/cbor output format.
+const lsCborEncodingType = cmds.EncodingType("application/cbor")
+
+// lsEvent is one line of the --stream NDJSON/CBOR output: a directory
+// header, a single link, or a directory footer, flattened out of the
+// header/links/footer LsObject shape so consumers don't have to buffer
+// whole LsOutput values to make sense of a stream. Fields are spelled out
+// explicitly (rather than embedding *LsLink) so the CBOR encoder has a
+// single concrete struct to walk instead of a pointer it has to chase.
+type lsEvent struct {
+	Event       string                 `json:"event"`
+	Path        string                 `json:"path,omitempty"`
+	Hash        string                 `json:"hash,omitempty"`
+	Name        string                 `json:"name,omitempty"`
+	Size        uint64                 `json:"size,omitempty"`
+	ContentSize uint64                 `json:"contentSize,omitempty"`
+	Type        unixfspb.Data_DataType `json:"type,omitempty"`
+	Mode        uint32                 `json:"mode,omitempty"`
+	Mtime       int64                  `json:"mtime,omitempty"`
+	MtimeNsecs  int32                  `json:"mtimeNsecs,omitempty"`
+	Target      string                 `json:"target,omitempty"`
+}
+
+// lsWantsEventStream reports whether req asked for the flattened
+// header/link/footer event encoding (--stream or --recursive). Non-stream,
+// non-recursive requests keep getting the whole LsOutput object so the
+// documented /api/v0/ls response shape and existing HTTP-API consumers
+// don't see anything different.
+func lsWantsEventStream(req *cmds.Request) bool {
+	stream, _ := req.Options[lsStreamOptionName].(bool)
+	recursive, _ := req.Options[lsRecursiveOptionName].(bool)
+	return stream || recursive
+}
+
+// lsEvents flattens every object in an LsOutput into its header/link/footer
+// events, shared by the NDJSON and CBOR encoders.
+func lsEvents(output *LsOutput) []lsEvent {
+	var events []lsEvent
+	for _, object := range output.Objects {
+		if object.HasHeader {
+			events = append(events, lsEvent{Event: "header", Path: object.Path, Hash: object.Hash})
+		}
+		for i := range object.Links {
+			link := object.Links[i]
+			events = append(events, lsEvent{
+				Event:       "link",
+				Path:        object.Path,
+				Name:        link.Name,
+				Hash:        link.Hash,
+				Size:        link.Size,
+				ContentSize: link.ContentSize,
+				Type:        link.Type,
+				Mode:        link.Mode,
+				Mtime:       link.Mtime,
+				MtimeNsecs:  link.MtimeNsecs,
+				Target:      link.Target,
+			})
+		}
+		if object.HasFooter {
+			events = append(events, lsEvent{Event: "footer", Path: object.Path})
+		}
+	}
+	return events
+}
+
+// encodeLsOutputNdjson emits one JSON object per header/link/footer event
+// for "ipfs ls --stream --enc=json" and "ipfs ls -r --enc=json". Any other
+// request keeps the original whole-LsOutput JSON encoding, since that's
+// also what the /api/v0/ls HTTP RPC has always returned.
+func encodeLsOutputNdjson(req *cmds.Request, w io.Writer, v interface{}) error {
+	output, ok := v.(*LsOutput)
+	if !ok {
+		return e.TypeErr(output, v)
+	}
+
+	if !lsWantsEventStream(req) {
+		return json.NewEncoder(w).Encode(output)
+	}
+
+	enc := json.NewEncoder(w)
+	for _, event := range lsEvents(output) {
+		if err := enc.Encode(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeLsOutputCbor is the --enc=application/cbor counterpart of
+// encodeLsOutputNdjson: the same flattened events, each written as its own
+// CBOR item back to back so a stream can be read without buffering, again
+// only for --stream/--recursive requests.
+func encodeLsOutputCbor(req *cmds.Request, w io.Writer, v interface{}) error {
+	output, ok := v.(*LsOutput)
+	if !ok {
+		return e.TypeErr(output, v)
+	}
+
+	if !lsWantsEventStream(req) {
+		b, err := ipldcbor.DumpObject(output)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	}
+
+	for _, event := range lsEvents(output) {
+		b, err := ipldcbor.DumpObject(event)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatLsLinkLong renders a single entry the way "ls -l" would: a
+// permission string, size, mtime, and name, following symlink targets.
+func formatLsLinkLong(link LsLink, name string) string {
+	line := fmt.Sprintf("%c%s\t%d", lsTypeChar(link.Type), lsPermString(link.Mode), link.Size)
+	if link.Mtime != 0 {
+		line += "\t" + time.Unix(link.Mtime, int64(link.MtimeNsecs)).UTC().Format("Jan _2 15:04")
+	} else {
+		line += "\t-"
+	}
+	line += "\t" + name
+	if link.Target != "" {
+		line += " -> " + link.Target
+	}
+	return line
+}
+
+func lsTypeChar(t unixfspb.Data_DataType) byte {
+	switch t {
+	case unixfs.TDirectory, unixfs.THAMTShard:
+		return 'd'
+	case unixfs.TSymlink:
+		return 'l'
+	default:
+		return '-'
+	}
+}
+
+func lsPermString(mode uint32) string {
+	if mode == 0 {
+		return "?????????"
+	}
+	perms := []byte("rwxrwxrwx")
+	for i := range perms {
+		if mode&(1<<uint(8-i)) == 0 {
+			perms[i] = '-'
+		}
+	}
+	return string(perms)
+}
+
+// makeLsFilter builds a name-matching predicate for --pattern, honoring
+// --pattern-syntax. An empty pattern yields a nil filter, which matches
+// everything.
+func makeLsFilter(pattern, syntax string) (func(name string) bool, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	switch syntax {
+	case "", lsPatternSyntaxGlob:
+		return func(name string) bool {
+			ok, _ := gopath.Match(pattern, name)
+			return ok
+		}, nil
+	case lsPatternSyntaxRegex:
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --pattern regex: %s", err)
+		}
+		return re.MatchString, nil
+	default:
+		return nil, fmt.Errorf("unknown --pattern-syntax %q, want \"glob\" or \"regex\"", syntax)
+	}
+}
+
+// filterLsLinks drops entries whose name doesn't match filter, preserving
+// order. A nil filter is a no-op.
+func filterLsLinks(links []LsLink, filter func(string) bool) []LsLink {
+	if filter == nil {
+		return links
+	}
+	out := links[:0]
+	for _, l := range links {
+		if filter(l.Name) {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// sortLsLinks sorts links in place by --sort. An empty sortBy is a no-op, so
+// the original (on-disk) link order is preserved by default.
+func sortLsLinks(links []LsLink, sortBy string, reverse bool) {
+	if sortBy == "" {
+		return
+	}
+	less := func(i, j int) bool {
+		switch sortBy {
+		case lsSortSize:
+			return links[i].Size < links[j].Size
+		case lsSortType:
+			return links[i].Type < links[j].Type
+		default: // lsSortName
+			return links[i].Name < links[j].Name
+		}
+	}
+	if reverse {
+		sort.SliceStable(links, func(i, j int) bool { return less(j, i) })
+		return
+	}
+	sort.SliceStable(links, less)
+}
+
 func makeDagNodeLinkResults(req *cmds.Request, dagnode ipld.Node) <-chan unixfs.LinkResult {
 	linkResults := make(chan unixfs.LinkResult)
 	go func() {
@@ -248,47 +735,462 @@ func makeDagNodeLinkResults(req *cmds.Request, dagnode ipld.Node) <-chan unixfs.
 	return linkResults
 }
 
+// lsWalker recursively enumerates directories for --recursive, emitting the
+// same header/links/footer LsObject triples as --stream but for every
+// subdirectory. All calls share a single dserv/ro pair (built from one
+// merkledag.NewSession) so sibling directories dedupe their block fetches,
+// and share sem to bound how many directories are read concurrently.
+type lsWalker struct {
+	req             *cmds.Request
+	res             cmds.ResponseEmitter
+	dserv           ipld.DAGService
+	ro              ipld.DAGService
+	resolve         bool
+	sizeMode        string
+	long            bool
+	filterFn        func(string) bool
+	sortBy          string
+	reverse         bool
+	multipleFolders bool
+	maxDepth        int
+	carOut          *carCollector
+	sem             chan struct{}
+
+	emitMu  sync.Mutex
+	errOnce sync.Once
+	err     error
+}
+
+func (w *lsWalker) fail(err error) {
+	w.errOnce.Do(func() { w.err = err })
+}
+
+func (w *lsWalker) emit(obj LsObject) {
+	w.emitMu.Lock()
+	defer w.emitMu.Unlock()
+	if w.err != nil {
+		return
+	}
+	if err := w.res.Emit(&LsOutput{w.multipleFolders, []LsObject{obj}}); err != nil {
+		w.fail(err)
+	}
+}
+
+// emitDir emits a whole directory's header, links, and footer as one
+// LsOutput so they can never be split apart by a concurrent sibling
+// directory's own emit landing in between.
+func (w *lsWalker) emitDir(header LsObject, links []LsLink, footer LsObject) {
+	w.emitMu.Lock()
+	defer w.emitMu.Unlock()
+	if w.err != nil {
+		return
+	}
+	objects := make([]LsObject, 0, 3)
+	objects = append(objects, header)
+	if len(links) > 0 {
+		linksObj := newDirectoryLinksLsObject(links)
+		linksObj.Path = header.Path
+		objects = append(objects, linksObj)
+	}
+	objects = append(objects, footer)
+	if err := w.res.Emit(&LsOutput{w.multipleFolders, objects}); err != nil {
+		w.fail(err)
+	}
+}
+
+// walk lists a single directory and, for each subdirectory it finds within
+// maxDepth, adds a child job to wg and hands it to sem-bounded goroutine.
+func (w *lsWalker) walk(wg *sync.WaitGroup, prefix string, dagnode ipld.Node, depth int) {
+	defer wg.Done()
+
+	dir, err := uio.NewDirectoryFromNode(w.ro, dagnode)
+	if err != nil && err != uio.ErrNotADir {
+		w.fail(fmt.Errorf("the data in %s (at %q) is not a UnixFS directory: %s", dagnode.Cid(), prefix, err))
+		return
+	}
+	if w.carOut != nil && dir != nil {
+		w.carOut.Add(dagnode)
+	}
+
+	var linkResults <-chan unixfs.LinkResult
+	if dir == nil {
+		linkResults = makeDagNodeLinkResults(w.req, dagnode)
+	} else {
+		linkResults = dir.EnumLinksAsync(w.req.Context)
+	}
+
+	header := newDirectoryHeaderLsObject(prefix)
+	header.Path = prefix
+
+	var subdirs []*ipld.Link
+	var links []LsLink
+	for linkResult := range linkResults {
+		if linkResult.Err != nil {
+			w.fail(linkResult.Err)
+			return
+		}
+		link := linkResult.Link
+		lsLink, linkNode, err := makeLsLink(w.req, w.dserv, w.resolve, w.sizeMode, true, w.long, link)
+		if err != nil {
+			w.fail(err)
+			return
+		}
+		if err := carAddLink(w.req.Context, w.dserv, w.carOut, link, linkNode); err != nil {
+			w.fail(err)
+			return
+		}
+
+		// A directory is always queued for recursive descent regardless of
+		// --pattern: the filter only decides what gets displayed, not what
+		// gets walked, so "ipfs ls -r --pattern='*.go'" still finds matches
+		// nested under directories whose own name doesn't match.
+		isDir := lsLink.Type == unixfs.TDirectory || lsLink.Type == unixfs.THAMTShard
+		if isDir && (w.maxDepth < 0 || depth < w.maxDepth) {
+			subdirs = append(subdirs, link)
+		}
+
+		if w.filterFn != nil && !w.filterFn(link.Name) {
+			continue
+		}
+
+		links = append(links, *lsLink)
+	}
+
+	if w.sortBy != "" {
+		sortLsLinks(links, w.sortBy, w.reverse)
+	}
+
+	footer := newDirectoryFooterLsObject()
+	footer.Path = prefix
+
+	// Emit this directory's header, links, and footer as a single LsOutput
+	// so a concurrent sibling directory's own emit can't land in between:
+	// with the default --concurrency>1, interleaving individual emit calls
+	// here would print (or flatten into NDJSON/CBOR) links under the wrong
+	// directory's header, since the text encoder only reprints a label on
+	// HasHeader objects.
+	w.emitDir(header, links, footer)
+
+	for _, link := range subdirs {
+		childPath := prefix + "/" + link.Name
+		wg.Add(1)
+		go func(link *ipld.Link, childPath string) {
+			// Acquire our slot from inside the goroutine, after the parent
+			// directory's own walk has already returned its slot (the defer
+			// in the caller that spawned us). Acquiring before spawning
+			// would hold the parent's slot while waiting for a child's,
+			// deadlocking once enough in-flight walks are waiting on sem.
+			w.sem <- struct{}{}
+			defer func() { <-w.sem }()
+			childNode, err := link.GetNode(w.req.Context, w.dserv)
+			if err != nil {
+				w.fail(err)
+				wg.Done()
+				return
+			}
+			w.walk(wg, childPath, childNode, depth+1)
+		}(link, childPath)
+	}
+}
+
 func newFullDirectoryLsObject(hash string, links []LsLink) LsObject {
-	return LsObject{hash, links, true, true, true}
+	return LsObject{Hash: hash, Links: links, HasHeader: true, HasLinks: true, HasFooter: true}
 }
 func newDirectoryHeaderLsObject(hash string) LsObject {
-	return LsObject{hash, nil, true, false, false}
+	return LsObject{Hash: hash, HasHeader: true}
 }
 func newDirectoryLinksLsObject(links []LsLink) LsObject {
-	return LsObject{"", links, false, true, false}
+	return LsObject{Links: links, HasLinks: true}
 }
 func newDirectoryFooterLsObject() LsObject {
-	return LsObject{"", nil, false, false, true}
+	return LsObject{HasFooter: true}
 }
 
-func makeLsLink(req *cmds.Request, dserv ipld.DAGService, resolve bool, link *ipld.Link) (*LsLink, error) {
+// carAddLink adds a directory entry's node to carOut for --to-car. makeLsLink
+// only resolves linkNode when it actually needs to look inside it (a
+// DagProtobuf node); a raw-leaf child is skipped there since the raw block
+// is already the content, so linkNode comes back nil and has to be fetched
+// here instead, or the CAR would be missing that file's block entirely.
+func carAddLink(ctx context.Context, dserv ipld.DAGService, carOut *carCollector, link *ipld.Link, linkNode ipld.Node) error {
+	if carOut == nil {
+		return nil
+	}
+	if linkNode == nil {
+		if link.Cid.Type() != cid.Raw {
+			return nil
+		}
+		var err error
+		linkNode, err = link.GetNode(ctx, dserv)
+		if err != nil {
+			return err
+		}
+	}
+	carOut.Add(linkNode)
+	return nil
+}
+
+// makeLsLink builds the printable LsLink for a directory entry, resolving
+// its target node when needed. It also returns the resolved node (nil if it
+// wasn't fetched) so callers building a --to-car output can collect it.
+func makeLsLink(req *cmds.Request, dserv ipld.DAGService, resolve bool, sizeMode string, recursive, long bool, link *ipld.Link) (*LsLink, ipld.Node, error) {
 	t := unixfspb.Data_DataType(-1)
+	wantContentSize := sizeMode == lsSizeContent || sizeMode == lsSizeBoth
 
+	var linkNode ipld.Node
+	var contentSize uint64
+	var mode uint32
+	var mtime int64
+	var mtimeNsecs int32
+	var target string
 	switch link.Cid.Type() {
 	case cid.Raw:
-		// No need to check with raw leaves
+		// No need to check with raw leaves; the raw block *is* the content.
 		t = unixfs.TFile
+		if wantContentSize {
+			contentSize = link.Size
+		}
 	case cid.DagProtobuf:
-		linkNode, err := link.GetNode(req.Context, dserv)
+		var err error
+		linkNode, err = link.GetNode(req.Context, dserv)
 		if err == ipld.ErrNotFound && !resolve {
 			// not an error
 			linkNode = nil
 		} else if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		if pn, ok := linkNode.(*merkledag.ProtoNode); ok {
 			d, err := unixfs.FSNodeFromBytes(pn.Data())
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 			t = d.Type()
+
+			if wantContentSize {
+				switch t {
+				case unixfs.TFile:
+					contentSize = d.FileSize()
+				case unixfs.TDirectory, unixfs.THAMTShard:
+					// Only worth the extra traversal when we're already
+					// walking the whole tree with --recursive.
+					if recursive {
+						contentSize, err = dirContentSize(req.Context, dserv, linkNode)
+						if err != nil {
+							return nil, nil, err
+						}
+					}
+				}
+			}
+
+			// Only decode mode/mtime/symlink-target when --long actually
+			// needs them, and only once we've already resolved the node;
+			// with --resolve-type=false, plain listings stay cheap.
+			if long && resolve {
+				mode = uint32(d.Mode())
+				if mt := d.ModTime(); !mt.IsZero() {
+					mtime = mt.Unix()
+					mtimeNsecs = int32(mt.Nanosecond())
+				}
+				if t == unixfs.TSymlink {
+					target = string(d.Data())
+				}
+			}
 		}
 	}
 	return &LsLink{
-		Name: link.Name,
-		Hash: link.Cid.String(),
-		Size: link.Size,
-		Type: t,
-	}, nil
+		Name:        link.Name,
+		Hash:        link.Cid.String(),
+		Size:        link.Size,
+		ContentSize: contentSize,
+		Type:        t,
+		Mode:        mode,
+		Mtime:       mtime,
+		MtimeNsecs:  mtimeNsecs,
+		Target:      target,
+	}, linkNode, nil
+}
+
+// dirContentSize sums the UnixFS content byte count of every file
+// transitively under nd, descending through HAMT shards transparently via
+// uio.Directory. Used for --size=content|both combined with --recursive.
+func dirContentSize(ctx context.Context, dserv ipld.DAGService, nd ipld.Node) (uint64, error) {
+	dir, err := uio.NewDirectoryFromNode(dserv, nd)
+	if err != nil {
+		return 0, err
+	}
+
+	var total uint64
+	for linkResult := range dir.EnumLinksAsync(ctx) {
+		if linkResult.Err != nil {
+			return 0, linkResult.Err
+		}
+		link := linkResult.Link
+
+		if link.Cid.Type() == cid.Raw {
+			total += link.Size
+			continue
+		}
+
+		childNode, err := link.GetNode(ctx, dserv)
+		if err != nil {
+			return 0, err
+		}
+		pn, ok := childNode.(*merkledag.ProtoNode)
+		if !ok {
+			total += link.Size
+			continue
+		}
+		d, err := unixfs.FSNodeFromBytes(pn.Data())
+		if err != nil {
+			return 0, err
+		}
+		switch d.Type() {
+		case unixfs.TDirectory, unixfs.THAMTShard:
+			sub, err := dirContentSize(ctx, dserv, childNode)
+			if err != nil {
+				return 0, err
+			}
+			total += sub
+		default:
+			total += d.FileSize()
+		}
+	}
+	return total, nil
+}
+
+// descendUnixfsPath walks a slash-separated UnixFS sub-path starting at nd,
+// resolving one directory entry at a time, so ls can list a directory nested
+// below the object the caller resolved or the root of a CAR file.
+func descendUnixfsPath(ctx context.Context, dserv ipld.DAGService, nd ipld.Node, subPath string) (ipld.Node, error) {
+	subPath = strings.Trim(subPath, "/")
+	if subPath == "" || subPath == "." {
+		return nd, nil
+	}
+
+	cur := nd
+	for _, name := range strings.Split(subPath, "/") {
+		parent := cur
+		dir, err := uio.NewDirectoryFromNode(dserv, parent)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a directory, cannot descend into %q", parent.Cid(), name)
+		}
+		cur, err = dir.Find(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("no link named %q under %s", name, parent.Cid())
+		}
+	}
+	return cur, nil
+}
+
+// splitCarPath splits an ipfs-path argument given alongside --from-car into
+// its root CID (possibly empty, meaning "use the CAR's own root") and the
+// remaining UnixFS sub-path.
+func splitCarPath(fpath string) (root, rest string) {
+	fpath = strings.TrimPrefix(fpath, "/ipfs/")
+	fpath = strings.Trim(fpath, "/")
+	if fpath == "" || fpath == "." {
+		return "", ""
+	}
+	parts := strings.SplitN(fpath, "/", 2)
+	if _, err := cid.Decode(parts[0]); err != nil {
+		// not a CID, treat the whole argument as a sub-path off the CAR root
+		return "", fpath
+	}
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// dagServiceFromCar loads every block out of a CAR file (or "-" for stdin)
+// into an in-memory blockstore and wraps it in an offline DAGService, so the
+// rest of LsCmd can treat it exactly like a local, read-only blockstore.
+func dagServiceFromCar(from string) (ipld.DAGService, []cid.Cid, error) {
+	var r io.Reader
+	if from == "-" {
+		r = os.Stdin
+	} else {
+		f, err := os.Open(from)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	cr, err := car.NewCarReader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bs := bstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	for {
+		blk, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := bs.Put(blk); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	bserv := blockservice.New(bs, offline.Exchange(bs))
+	return merkledag.NewDAGService(bserv), cr.Header.Roots, nil
+}
+
+// carCollector accumulates the blocks traversed while listing so they can be
+// written back out as a CAR via --to-car: the root(s), the directory node(s),
+// and one level of resolved children.
+// carCollector is shared across the lsWalker goroutines spawned for
+// --recursive, so every access is guarded by mu.
+type carCollector struct {
+	mu     sync.Mutex
+	roots  []cid.Cid
+	seen   map[string]bool
+	blocks []ipld.Node
+}
+
+func newCarCollector() *carCollector {
+	return &carCollector{seen: map[string]bool{}}
+}
+
+func (c *carCollector) AddRoot(id cid.Cid) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.roots = append(c.roots, id)
+}
+
+func (c *carCollector) Add(nd ipld.Node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := nd.Cid().KeyString()
+	if c.seen[k] {
+		return
+	}
+	c.seen[k] = true
+	c.blocks = append(c.blocks, nd)
+}
+
+func (c *carCollector) WriteFile(to string) error {
+	f, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := car.WriteHeader(&car.CarHeader{Roots: c.roots, Version: 1}, f); err != nil {
+		return err
+	}
+	for _, nd := range c.blocks {
+		if err := carutil.LdWrite(f, nd.Cid().Bytes(), nd.RawData()); err != nil {
+			return err
+		}
+	}
+	return nil
 }